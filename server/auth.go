@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// authenticator validates an incoming request and returns the identity to
+// log for it. identity is ignored when ok is false.
+type authenticator interface {
+	authenticate(r *http.Request) (identity string, ok bool)
+}
+
+// noAuth is used when no credentials are configured, preserving the
+// module's historical open-by-default behavior.
+type noAuth struct{}
+
+func (noAuth) authenticate(r *http.Request) (string, bool) {
+	return "anonymous", true
+}
+
+// tokenAuth validates requests against a set of bearer tokens, each mapped
+// to the identity it authenticates as. It is populated from
+// KWKHTMLTOPDF_TOKEN (a single token, identity "token") and/or
+// KWKHTMLTOPDF_AUTH_FILE (a .netrc-style file mapping many tokens to
+// identities).
+type tokenAuth struct {
+	mu         sync.RWMutex
+	identities map[string]string // token -> identity
+}
+
+// loadAuthFile parses a .netrc-style credentials file of the form:
+//
+//	machine <api-key> login <identity>
+//
+// one entry per line (or per "machine" stanza), mirroring the shape Go's
+// cmd/go/internal/auth package reads for registry credentials.
+func loadAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities := make(map[string]string)
+	var key, login string
+	flush := func() {
+		if key != "" && login != "" {
+			identities[key] = login
+		}
+		key, login = "", ""
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "machine":
+				flush()
+				key = fields[i+1]
+			case "login":
+				login = fields[i+1]
+			}
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// newTokenAuth builds an authenticator from the environment, or returns nil
+// if no credentials are configured.
+func newTokenAuth() (*tokenAuth, error) {
+	identities := make(map[string]string)
+
+	if tok := os.Getenv("KWKHTMLTOPDF_TOKEN"); tok != "" {
+		identities[tok] = "token"
+	}
+
+	if path := os.Getenv("KWKHTMLTOPDF_AUTH_FILE"); path != "" {
+		fileIdentities, err := loadAuthFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for tok, identity := range fileIdentities {
+			identities[tok] = identity
+		}
+	}
+
+	if len(identities) == 0 {
+		return nil, nil
+	}
+	return &tokenAuth{identities: identities}, nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if strings.HasPrefix(auth, prefix) {
+		return strings.TrimPrefix(auth, prefix)
+	}
+	return ""
+}
+
+func (a *tokenAuth) authenticate(r *http.Request) (string, bool) {
+	tok := bearerToken(r)
+	if tok == "" {
+		return "", false
+	}
+	a.mu.RLock()
+	identity, ok := a.identities[tok]
+	a.mu.RUnlock()
+	return identity, ok
+}
+
+// newAuthenticator builds the authenticator to use for the server, falling
+// back to noAuth when no credentials are configured in the environment.
+func newAuthenticator() (authenticator, error) {
+	auth, err := newTokenAuth()
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return noAuth{}, nil
+	}
+	return auth, nil
+}
+
+func requireAuth(w http.ResponseWriter, r *http.Request, auth authenticator) (identity string, ok bool) {
+	identity, ok = auth.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kwkhtmltopdf"`)
+		httpError(w, errAuthRequired, http.StatusUnauthorized)
+		return "", false
+	}
+	return identity, true
+}
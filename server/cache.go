@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// renderCache is an on-disk, content-addressable LRU cache of rendered
+// PDFs, keyed by the options and input file contents that produced them.
+// Eviction happens on put, oldest entry first, once the configured size
+// budget is exceeded.
+type renderCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// newRenderCache opens (and if necessary creates) dir as a cache directory,
+// indexing any entries already on disk from a previous run.
+func newRenderCache(dir string, maxBytes int64) (*renderCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &renderCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".pdf") {
+			continue
+		}
+		key := strings.TrimSuffix(fi.Name(), ".pdf")
+		entry := &cacheEntry{key: key, size: fi.Size()}
+		c.entries[key] = c.order.PushFront(entry)
+		c.size += fi.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *renderCache) path(key string) string {
+	return filepath.Join(c.dir, key+".pdf")
+}
+
+// newTempFile creates a temp file inside the cache directory itself (not
+// the system temp dir) so that put's os.Rename into c.dir always lands on
+// the same filesystem; renaming across a mount boundary fails with
+// "invalid cross-device link".
+func (c *renderCache) newTempFile() (*os.File, error) {
+	return ioutil.TempFile(c.dir, "tmp")
+}
+
+// get returns the path to the cached PDF for key, touching it as
+// most-recently-used, or ok=false if there is no cached entry.
+func (c *renderCache) get(key string) (path string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[key]
+	if !found {
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return c.path(key), true
+}
+
+// put adopts the file at tmpPath as the cached entry for key, evicting
+// older entries as needed to stay within maxBytes.
+func (c *renderCache) put(key, tmpPath string, size int64) error {
+	dest := c.path(key)
+	if err := os.Rename(tmpPath, dest); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		c.size -= el.Value.(*cacheEntry).size
+		c.order.MoveToFront(el)
+		el.Value.(*cacheEntry).size = size
+	} else {
+		c.entries[key] = c.order.PushFront(&cacheEntry{key: key, size: size})
+	}
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// evict removes least-recently-used entries until the cache is back under
+// its size budget. Callers must hold c.mu.
+func (c *renderCache) evict() {
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		oldest := c.order.Back()
+		if oldest == nil {
+			return
+		}
+		entry := oldest.Value.(*cacheEntry)
+		os.Remove(c.path(entry.key))
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+	}
+}
+
+// purge empties the cache.
+func (c *renderCache) purge() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		os.Remove(c.path(el.Value.(*cacheEntry).key))
+	}
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.size = 0
+	return nil
+}
+
+// newCacheFromEnv builds a renderCache from KWKHTMLTOPDF_CACHE_DIR and
+// KWKHTMLTOPDF_CACHE_MAX_BYTES, or returns nil if caching is not
+// configured.
+func newCacheFromEnv() (*renderCache, error) {
+	dir := os.Getenv("KWKHTMLTOPDF_CACHE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	maxBytes := int64(1 << 30) // 1GiB default
+	if v := os.Getenv("KWKHTMLTOPDF_CACHE_MAX_BYTES"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KWKHTMLTOPDF_CACHE_MAX_BYTES: %w", err)
+		}
+		maxBytes = parsed
+	}
+	return newRenderCache(dir, maxBytes)
+}
+
+// groupOptionArgs groups a flat optionArgs slice into one string per
+// flag, using the same p.arity that redactArgs and policy.validate use to
+// know how many trailing tokens belong to a given flag (e.g. --cookie
+// <name> <value> is one group, not three independent tokens) - including
+// flags a policy's own Sensitive map declares beyond the static
+// knownOptions table. Without this, sorting the flattened tokens would
+// scatter a flag's values away from it and let requests that merely swap
+// two flags' values collide on the same key.
+func groupOptionArgs(optionArgs []string, pol *policy) []string {
+	var groups []string
+	i := 0
+	for i < len(optionArgs) {
+		arg := optionArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			groups = append(groups, "opt:"+arg)
+			i++
+			continue
+		}
+		end := i + 1 + pol.arity(arg)
+		if end > len(optionArgs) {
+			end = len(optionArgs)
+		}
+		groups = append(groups, "opt:"+strings.Join(optionArgs[i:end], "\x1f"))
+		i = end
+	}
+	return groups
+}
+
+// cacheKey derives a content-addressable key from the canonicalized
+// option arguments and the SHA-256 digests of each uploaded file's
+// contents, so identical requests (same options, same bytes) map to the
+// same key regardless of submission order.
+func cacheKey(optionArgs []string, fileHashes map[string]string, pol *policy) string {
+	groups := groupOptionArgs(optionArgs, pol)
+	sort.Strings(groups)
+
+	names := make([]string, 0, len(fileHashes))
+	for name := range fileHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, group := range groups {
+		fmt.Fprintf(h, "%s\x00", group)
+	}
+	for _, name := range names {
+		fmt.Fprintf(h, "file:%s:%s\x00", name, fileHashes[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
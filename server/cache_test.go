@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCacheKeyStableUnderReordering(t *testing.T) {
+	a := cacheKey([]string{"--password", "secret1", "--proxy", "proxy1"}, nil, defaultPolicy())
+	b := cacheKey([]string{"--proxy", "proxy1", "--password", "secret1"}, nil, defaultPolicy())
+	if a != b {
+		t.Errorf("expected reordered option args to produce the same key, got %q and %q", a, b)
+	}
+}
+
+// TestCacheKeyDistinguishesSwappedValues is a regression test for the
+// cache key collision this module's arity grouping exists to prevent:
+// --password and --proxy (both known arity-1 flags) must each keep their
+// own value, not get flattened into an interchangeable multiset of
+// tokens that a value swap leaves unchanged.
+func TestCacheKeyDistinguishesSwappedValues(t *testing.T) {
+	a := cacheKey([]string{"--password", "secret1", "--proxy", "proxy1"}, nil, defaultPolicy())
+	b := cacheKey([]string{"--password", "proxy1", "--proxy", "secret1"}, nil, defaultPolicy())
+	if a == b {
+		t.Errorf("swapping --password and --proxy's values must not collide, both hashed to %q", a)
+	}
+}
+
+func TestCacheKeyUsesPolicyArityForCustomSensitiveFlags(t *testing.T) {
+	pol := &policy{Sensitive: map[string]int{"--custom-secret": 1}}
+	if err := pol.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	a := cacheKey([]string{"--custom-secret", "one", "two"}, nil, pol)
+	b := cacheKey([]string{"--custom-secret", "two", "one"}, nil, pol)
+	if a == b {
+		t.Errorf("swapping --custom-secret's value with an unrelated token must not collide, both hashed to %q", a)
+	}
+}
+
+func TestRenderCachePutAndGet(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newRenderCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("newRenderCache: %v", err)
+	}
+
+	tmp, err := c.newTempFile()
+	if err != nil {
+		t.Fatalf("newTempFile: %v", err)
+	}
+	if _, err := tmp.WriteString("pdf bytes"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	tmp.Close()
+
+	if err := c.put("key1", tmp.Name(), 9); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected put to rename the temp file away, but it still exists at %s", tmp.Name())
+	}
+
+	path, ok := c.get("key1")
+	if !ok {
+		t.Fatal("expected get to find the entry just put")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("cached file missing at %s: %v", path, err)
+	}
+}
+
+func TestRenderCacheEvictsOldestOverBudget(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newRenderCache(dir, 10)
+	if err != nil {
+		t.Fatalf("newRenderCache: %v", err)
+	}
+
+	put := func(key string, size int64) {
+		tmp, err := c.newTempFile()
+		if err != nil {
+			t.Fatalf("newTempFile: %v", err)
+		}
+		tmp.Close()
+		if err := c.put(key, tmp.Name(), size); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	put("a", 6)
+	put("b", 6) // pushes total to 12 > 10, "a" should be evicted
+
+	if _, ok := c.get("a"); ok {
+		t.Error("expected \"a\" to have been evicted once the cache exceeded its byte budget")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Error("expected \"b\" to remain cached")
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jobState string
+
+const (
+	jobQueued  jobState = "queued"
+	jobRunning jobState = "running"
+	jobDone    jobState = "done"
+	jobError   jobState = "error"
+)
+
+// job tracks one asynchronous render submitted through POST /jobs.
+type job struct {
+	id          string
+	dir         string
+	callbackURL string
+
+	mu         sync.Mutex
+	state      jobState
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	stderrTail string
+	errMsg     string
+	resultPath string
+}
+
+func (j *job) snapshot() jobStatusJSON {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := jobStatusJSON{
+		ID:         j.id,
+		Status:     string(j.state),
+		CreatedAt:  j.createdAt.UTC(),
+		StderrTail: j.stderrTail,
+		Error:      j.errMsg,
+	}
+	if !j.startedAt.IsZero() {
+		s.StartedAt = &j.startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		s.FinishedAt = &j.finishedAt
+	}
+	return s
+}
+
+type jobStatusJSON struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	StderrTail string     `json:"stderr_tail,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// jobStore tracks in-flight and recently completed async jobs, persisting
+// their inputs and output under dir so /jobs/{id}/result can be served
+// after the submitting request has returned. Entries older than ttl are
+// swept up by cleanup.
+type jobStore struct {
+	dir string
+	ttl time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// newJobStoreFromEnv builds a jobStore from KWKHTMLTOPDF_JOBS_DIR and
+// KWKHTMLTOPDF_JOB_TTL (a time.ParseDuration string, default 1h), or
+// returns nil if the async job API is not configured.
+func newJobStoreFromEnv() (*jobStore, error) {
+	dir := os.Getenv("KWKHTMLTOPDF_JOBS_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	ttl := time.Hour
+	if v := os.Getenv("KWKHTMLTOPDF_JOB_TTL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KWKHTMLTOPDF_JOB_TTL: %w", err)
+		}
+		ttl = parsed
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &jobStore{dir: dir, ttl: ttl, jobs: make(map[string]*job)}, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// submit materializes a render request's files under the job's own
+// directory (since the caller's temp dir is removed once this request
+// returns) and starts the render in the background via pool.
+func (s *jobStore) submit(req *renderRequest, callbackURL string, pool *renderPool) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.dir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	args, err := rehomeFileArgs(req, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	args = append(args, "-")
+
+	j := &job{
+		id:          id,
+		dir:         dir,
+		callbackURL: callbackURL,
+		state:       jobQueued,
+		createdAt:   time.Now(),
+	}
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.mu.Unlock()
+
+	go s.run(j, args, pool)
+	return j, nil
+}
+
+// rehomeFileArgs copies any input files referenced by req.args into dir,
+// rewriting the argument list to point at the copies, so job input
+// survives after the originating request's temp dir is removed.
+func rehomeFileArgs(req *renderRequest, dir string) ([]string, error) {
+	known := make(map[string]bool, len(req.fileHashes))
+	for name := range req.fileHashes {
+		known[name] = true
+	}
+	args := make([]string, 0, len(req.args))
+	for _, arg := range req.args {
+		base := filepath.Base(arg)
+		if !known[base] {
+			args = append(args, arg)
+			continue
+		}
+		dst := filepath.Join(dir, base)
+		if err := copyFile(arg, dst); err != nil {
+			return nil, err
+		}
+		args = append(args, dst)
+	}
+	return args, nil
+}
+
+// validateCallbackURL rejects callback URLs that would let an untrusted
+// caller make this server issue requests to loopback, link-local, or
+// private-network addresses - e.g. a cloud metadata endpoint or an
+// internal-only service (SSRF), since callback_url is otherwise taken
+// verbatim from the request. KWKHTMLTOPDF_CALLBACK_ALLOW_HOSTS (a
+// comma-separated list of hostnames) lets an operator explicitly permit
+// specific internal callback targets.
+//
+// On success it also returns the IP that was actually checked (nil for a
+// KWKHTMLTOPDF_CALLBACK_ALLOW_HOSTS match), so a caller can pin its
+// eventual dial to that address instead of re-resolving the hostname -
+// re-resolving would let a DNS-rebinding attacker swap in a disallowed
+// address between this check and the connection.
+func validateCallbackURL(rawURL string) (net.IP, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback_url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid callback_url: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, errors.New("invalid callback_url: missing host")
+	}
+	for _, allowed := range strings.Split(os.Getenv("KWKHTMLTOPDF_CALLBACK_ALLOW_HOSTS"), ",") {
+		if allowed != "" && strings.EqualFold(allowed, host) {
+			return nil, nil
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if isDisallowedCallbackIP(ip) {
+			return nil, fmt.Errorf("callback_url: %q resolves to disallowed address %s", host, ip)
+		}
+		return ip, nil
+	}
+	resolved, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("callback_url: cannot resolve host %q: %w", host, err)
+	}
+	for _, ip := range resolved {
+		if isDisallowedCallbackIP(ip) {
+			return nil, fmt.Errorf("callback_url: %q resolves to disallowed address %s", host, ip)
+		}
+	}
+	return resolved[0], nil
+}
+
+// isDisallowedCallbackIP reports whether ip is loopback, link-local, or
+// private-range - the address classes a caller could otherwise use to
+// reach this server's own host or an internal-only service instead of a
+// real webhook receiver.
+func isDisallowedCallbackIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (s *jobStore) run(j *job, args []string, pool *renderPool) {
+	release, err := pool.acquire(context.Background())
+	if err != nil {
+		s.finish(j, "", err)
+		return
+	}
+	defer func() { release(j.snapshot().Status == string(jobDone)) }()
+
+	j.mu.Lock()
+	j.state = jobRunning
+	j.startedAt = time.Now()
+	j.mu.Unlock()
+
+	resultPath := filepath.Join(j.dir, "result.pdf")
+	out, err := os.Create(resultPath)
+	if err != nil {
+		s.finish(j, "", err)
+		return
+	}
+	defer out.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(wkhtmltopdfBin(), args...)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	j.mu.Lock()
+	j.stderrTail = tail(stderr.String(), 4096)
+	j.mu.Unlock()
+
+	if err != nil {
+		s.finish(j, resultPath, err)
+		return
+	}
+	s.finish(j, resultPath, nil)
+}
+
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
+
+func (s *jobStore) finish(j *job, resultPath string, runErr error) {
+	j.mu.Lock()
+	j.finishedAt = time.Now()
+	if runErr != nil {
+		j.state = jobError
+		j.errMsg = runErr.Error()
+	} else {
+		j.state = jobDone
+		j.resultPath = resultPath
+	}
+	j.mu.Unlock()
+
+	if j.callbackURL != "" {
+		go s.callback(j)
+	}
+}
+
+// callbackRedirectPolicy disables following redirects for all webhook
+// deliveries: http.DefaultClient's default of following up to 10
+// redirects would let a callback target that passed validateCallbackURL
+// simply redirect the request to a loopback/private address after the
+// fact, defeating the check.
+func callbackRedirectPolicy(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// callbackClient is used when validateCallbackURL didn't return an IP to
+// pin to (a KWKHTMLTOPDF_CALLBACK_ALLOW_HOSTS match, where the operator
+// has already accepted the risk of whatever the hostname resolves to).
+var callbackClient = &http.Client{CheckRedirect: callbackRedirectPolicy}
+
+// pinnedCallbackClient returns an http.Client that dials ip for every
+// connection regardless of what the request's host resolves to at dial
+// time. validateCallbackURL's re-check at dispatch time closes most of
+// the DNS-rebinding window, but net.LookupIP and the client's own dial
+// are still two separate resolutions unless pinned together; this makes
+// them one.
+func pinnedCallbackClient(ip net.IP) *http.Client {
+	dialer := &net.Dialer{}
+	return &http.Client{
+		CheckRedirect: callbackRedirectPolicy,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			},
+		},
+	}
+}
+
+// callback POSTs the finished job's result (or a JSON error) to its
+// callback_url, signing the body with HMAC-SHA256 over
+// KWKHTMLTOPDF_CALLBACK_SECRET so the receiver can verify authenticity.
+func (s *jobStore) callback(j *job) {
+	// Re-validate rather than trusting the check done at submission time:
+	// the job may have queued and rendered for a while, long enough for a
+	// DNS record the check resolved to a public address to be rebound to
+	// a loopback/private one by the time we actually dial it. The
+	// returned IP (if any) is then pinned so the actual dial below can't
+	// be re-resolved to something else again.
+	pinnedIP, err := validateCallbackURL(j.callbackURL)
+	if err != nil {
+		log.Println("job", j.id, "callback blocked:", err)
+		return
+	}
+	client := callbackClient
+	if pinnedIP != nil {
+		client = pinnedCallbackClient(pinnedIP)
+	}
+
+	status := j.snapshot()
+
+	var body []byte
+	contentType := "application/json"
+	if status.Status == string(jobDone) {
+		data, err := ioutil.ReadFile(j.resultPath)
+		if err != nil {
+			log.Println("job", j.id, "callback read failed:", err)
+			return
+		}
+		body = data
+		contentType = "application/pdf"
+	} else {
+		data, err := json.Marshal(status)
+		if err != nil {
+			log.Println("job", j.id, "callback marshal failed:", err)
+			return
+		}
+		body = data
+	}
+
+	req, err := http.NewRequest(http.MethodPost, j.callbackURL, bytes.NewReader(body))
+	if err != nil {
+		log.Println("job", j.id, "callback request failed:", err)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+	if secret := os.Getenv("KWKHTMLTOPDF_CALLBACK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Kwkhtmltopdf-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("job", j.id, "callback delivery failed:", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// cleanup removes job directories (and their in-memory state) older than
+// s.ttl. It's meant to be called periodically from a background
+// goroutine started in main.
+func (s *jobStore) cleanup() {
+	cutoff := time.Now().Add(-s.ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		j.mu.Lock()
+		old := j.createdAt.Before(cutoff) && j.state != jobQueued && j.state != jobRunning
+		j.mu.Unlock()
+		if old {
+			os.RemoveAll(j.dir)
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// serveJobs routes the /jobs and /jobs/{id}[/result] endpoints of the
+// async job API.
+func serveJobs(w http.ResponseWriter, r *http.Request, jobs *jobStore, pool *renderPool, pol *policy) {
+	if jobs == nil {
+		httpError(w, errors.New("async job API not configured"), http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Path == "/jobs" {
+		if r.Method != http.MethodPost {
+			httpError(w, errors.New("http method not allowed: "+r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		serveJobSubmit(w, r, jobs, pool, pol)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	id, sub, hasSub := strings.Cut(rest, "/")
+	j, ok := jobs.get(id)
+	if !ok {
+		httpError(w, errors.New("job not found: "+id), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case !hasSub:
+		if r.Method != http.MethodGet {
+			httpError(w, errors.New("http method not allowed: "+r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(j.snapshot())
+	case sub == "result":
+		if r.Method != http.MethodGet {
+			httpError(w, errors.New("http method not allowed: "+r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		serveJobResult(w, r, j)
+	default:
+		httpError(w, errors.New("path not found: "+r.URL.Path), http.StatusNotFound)
+	}
+}
+
+func serveJobSubmit(w http.ResponseWriter, r *http.Request, jobs *jobStore, pool *renderPool, pol *policy) {
+	tmpdir, err := ioutil.TempDir("", "kwk-job")
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	req, err := parseRenderRequest(r, tmpdir)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if violations := pol.validate(req.optionArgs); len(violations) > 0 {
+		httpJSONError(w, http.StatusBadRequest, violations)
+		return
+	}
+
+	if req.callbackURL != "" {
+		if _, err := validateCallbackURL(req.callbackURL); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	j, err := jobs.submit(req, req.callbackURL, pool)
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j.snapshot())
+}
+
+func serveJobResult(w http.ResponseWriter, r *http.Request, j *job) {
+	status := j.snapshot()
+	switch status.Status {
+	case string(jobDone):
+		f, err := os.Open(j.resultPath)
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	case string(jobError):
+		httpError(w, errors.New(status.Error), http.StatusUnprocessableEntity)
+	default:
+		httpError(w, errors.New("job not finished: "+status.Status), http.StatusConflict)
+	}
+}
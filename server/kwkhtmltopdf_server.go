@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,16 +15,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-// TODO ignore opts?
-// --log-level, -q, --quiet, --read-args-from-stdin, --dump-default-toc-xsl
-// --dump-outline <file>, --allow <path>, --cache-dir <path>,
-// --disable-local-file-access, --enable-local-file-access
-
-// TODO sensitive opts to be hidden from log
-// --cookie <name> <value>, --password <password>,
-// --ssl-key-password <password>
+var errAuthRequired = errors.New("missing or invalid credentials")
 
 func wkhtmltopdfBin() string {
 	bin := os.Getenv("KWKHTMLTOPDF_BIN")
@@ -52,6 +52,18 @@ func httpError(w http.ResponseWriter, err error, code int) {
 	http.Error(w, err.Error(), code)
 }
 
+// httpJSONError reports a structured error as JSON, used for policy
+// rejections so clients can tell which options were offending.
+func httpJSONError(w http.ResponseWriter, code int, violations []policyViolation) {
+	log.Println("policy rejected request:", violations)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error      string            `json:"error"`
+		Violations []policyViolation `json:"violations"`
+	}{"request violates option policy", violations})
+}
+
 func httpAbort(w http.ResponseWriter, err error) {
 	log.Println(err)
 	// abort chunked encoding response as crude way to report error to client
@@ -68,22 +80,105 @@ func httpAbort(w http.ResponseWriter, err error) {
 	c.Close()
 }
 
-func redactArgs(args []string) []string {
+// redactArgs masks the values of sensitive flags (--cookie, --password,
+// --ssl-key-password, --proxy by default, plus any the policy marks
+// sensitive) so they don't end up in plaintext logs. For a flag with
+// multiple values (e.g. --cookie <name> <value>) only the last value is
+// masked, keeping the rest for context.
+func redactArgs(args []string, p *policy) []string {
 	redacted := make([]string, 0, len(args))
 	i := 0
 	for i < len(args) {
-		if args[i] == "--cookie" && i+2 < len(args) {
-			redacted = append(redacted, args[i], args[i+1], "***")
-			i += 3
-		} else {
-			redacted = append(redacted, args[i])
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			redacted = append(redacted, arg)
 			i++
+			continue
 		}
+		arity := p.arity(arg)
+		sensitive := p.isSensitive(arg)
+		redacted = append(redacted, arg)
+		for j := 1; j <= arity && i+j < len(args); j++ {
+			if sensitive && j == arity {
+				redacted = append(redacted, "***")
+			} else {
+				redacted = append(redacted, args[i+j])
+			}
+		}
+		i += 1 + arity
 	}
 	return redacted
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+// renderRequest is the parsed form of a multipart render request, shared
+// by the synchronous /pdf handler and the asynchronous /jobs handler.
+type renderRequest struct {
+	args        []string
+	optionArgs  []string
+	fileHashes  map[string]string
+	docOutput   bool
+	callbackURL string
+}
+
+// parseRenderRequest reads a multipart request body, writing any "file"
+// parts under tmpdir and collecting "option" parts (and, for the async
+// job API, an optional "callback_url" part) into a renderRequest.
+func parseRenderRequest(r *http.Request, tmpdir string) (*renderRequest, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &renderRequest{fileHashes: make(map[string]string)}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch part.FormName() {
+		case "option":
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(part)
+			arg := buf.String()
+			req.args = append(req.args, arg)
+			req.optionArgs = append(req.optionArgs, arg)
+			if isDocOption(arg) {
+				req.docOutput = true
+			}
+		case "callback_url":
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(part)
+			req.callbackURL = buf.String()
+		case "file":
+			// It's important to preserve as much as possible of the
+			// original filename because some javascript can depend on it
+			// through document.location.
+			name := filepath.Base(part.FileName())
+			path := filepath.Join(tmpdir, name)
+			// TODO what if multiple files with same basename?
+			file, err := os.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.New()
+			_, err = io.Copy(io.MultiWriter(file, h), part)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+			req.fileHashes[name] = hex.EncodeToString(h.Sum(nil))
+			req.args = append(req.args, path)
+		default:
+			return nil, errors.New("unpexpected part name: " + part.FormName())
+		}
+	}
+	return req, nil
+}
+
+func handler(w http.ResponseWriter, r *http.Request, auth authenticator, cache *renderCache, pool *renderPool, jobs *jobStore, pol *policy) {
 
 	if r.URL.Path == "/status" {
 		w.WriteHeader(http.StatusOK)
@@ -92,6 +187,49 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		// don't log status
 		log.Printf("%s %s", r.Method, r.URL.Path)
 	}
+
+	identity, ok := requireAuth(w, r, auth)
+	if !ok {
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		metricsHandler(w, r, pool)
+		return
+	}
+
+	if r.URL.Path == "/jobs" || strings.HasPrefix(r.URL.Path, "/jobs/") {
+		serveJobs(w, r, jobs, pool, pol)
+		return
+	}
+
+	if r.URL.Path == "/render" {
+		if r.Method != http.MethodPost {
+			httpError(w, errors.New("http method not allowed: "+r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		serveRender(w, r, identity, cache, pool, pol)
+		return
+	}
+
+	if r.URL.Path == "/cache/purge" {
+		if r.Method != http.MethodPost {
+			httpError(w, errors.New("http method not allowed: "+r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if cache == nil {
+			httpError(w, errors.New("cache not configured"), http.StatusNotFound)
+			return
+		}
+		if err := cache.purge(); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		log.Println(identity, "cache purged")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		httpError(w, errors.New("http method not allowed: "+r.Method), http.StatusMethodNotAllowed)
 		return
@@ -110,53 +248,19 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer os.RemoveAll(tmpdir)
 
-	// parse request
-	reader, err := r.MultipartReader()
+	req, err := parseRenderRequest(r, tmpdir)
 	if err != nil {
 		httpError(w, err, http.StatusBadRequest)
 		return
 	}
-	var docOutput bool
-	var args []string
-	for {
-		part, err := reader.NextPart()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			httpError(w, err, http.StatusBadRequest)
-			return
-		}
-		if part.FormName() == "option" {
-			buf := new(bytes.Buffer)
-			buf.ReadFrom(part)
-			arg := buf.String()
-			args = append(args, arg)
-			if isDocOption(arg) {
-				docOutput = true
-			}
-		} else if part.FormName() == "file" {
-			// It's important to preserve as much as possible of the
-			// original filename because some javascript can depend on it
-			// through document.location.
-			path := filepath.Join(tmpdir, filepath.Base(part.FileName()))
-			// TODO what if multiple files with same basename?
-			file, err := os.Create(path)
-			if err != nil {
-				httpError(w, err, http.StatusBadRequest)
-				return
-			}
-			_, err = io.Copy(file, part)
-			file.Close()
-			if err != nil {
-				httpError(w, err, http.StatusBadRequest)
-				return
-			}
-			args = append(args, path)
-		} else {
-			httpError(w, errors.New("unpexpected part name: "+part.FormName()), http.StatusBadRequest)
-			return
-		}
+	docOutput := req.docOutput
+	args := req.args
+	optionArgs := req.optionArgs
+	fileHashes := req.fileHashes
+
+	if violations := pol.validate(optionArgs); len(violations) > 0 {
+		httpJSONError(w, http.StatusBadRequest, violations)
+		return
 	}
 
 	if docOutput {
@@ -166,11 +270,62 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		args = append(args, "-")
 	}
 
-	var redactedArgs = redactArgs(args)
+	// doc-output requests (--help, --version, etc.) aren't renders and
+	// aren't cached.
+	cacheable := cache != nil && !docOutput
+	renderAndStream(w, r, identity, args, optionArgs, fileHashes, cacheable, cache, pool, pol)
+}
+
+// renderAndStream invokes wkhtmltopdf with args (serving a cached result
+// instead if one already exists for optionArgs/fileHashes) and streams
+// its stdout to w, caching the output afterwards when cacheable. It is
+// shared by the multipart /pdf handler and the JSON /render handler.
+func renderAndStream(w http.ResponseWriter, r *http.Request, identity string, args, optionArgs []string, fileHashes map[string]string, cacheable bool, cache *renderCache, pool *renderPool, pol *policy) {
+	var redactedArgs = redactArgs(args, pol)
+
+	var key string
+	if cacheable {
+		key = cacheKey(optionArgs, fileHashes, pol)
+		if path, ok := cache.get(key); ok {
+			f, err := os.Open(path)
+			if err == nil {
+				defer f.Close()
+				fi, err := f.Stat()
+				if err == nil {
+					log.Println(identity, redactedArgs, "cache hit")
+					w.Header().Set("ETag", `"`+key+`"`)
+					w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+					http.ServeContent(w, r, "", fi.ModTime(), f)
+					return
+				}
+			}
+		}
+	}
+
+	release, err := pool.acquire(r.Context())
+	if err == errQueueFull {
+		w.Header().Set("Retry-After", "5")
+		httpError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// request queued successfully but waited longer than
+		// KWKHTMLTOPDF_QUEUE_TIMEOUT for a worker slot
+		w.Header().Set("Retry-After", "5")
+		httpError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// client went away while waiting for a worker slot
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	succeeded := false
+	defer func() { release(succeeded) }()
 
-	log.Println(redactedArgs, "starting")
+	log.Println(identity, redactedArgs, "starting")
 
-	cmd := exec.Command(wkhtmltopdfBin(), args...)
+	cmd := exec.CommandContext(r.Context(), wkhtmltopdfBin(), args...)
 	cmdStdout, err := cmd.StdoutPipe()
 	if err != nil {
 		httpError(w, err, http.StatusInternalServerError)
@@ -182,8 +337,35 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+
+	var cacheWriter io.Writer
+	var cacheTmp *os.File
+	if cacheable {
+		cacheTmp, err = cache.newTempFile()
+		if err == nil {
+			cacheWriter = cacheTmp
+		}
+	}
+	// cacheTmp lives inside the cache dir itself (see newTempFile), so
+	// unlike a system-tempdir file it is never cleaned up by anything
+	// else; remove it on every path that doesn't hand it off to
+	// cache.put below, or a failed/aborted render leaks it forever.
+	defer func() {
+		if cacheTmp != nil {
+			cacheTmp.Close()
+			os.Remove(cacheTmp.Name())
+		}
+	}()
+
+	if cacheable {
+		w.Header().Set("ETag", `"`+key+`"`)
+	}
 	w.WriteHeader(http.StatusOK)
-	_, err = io.Copy(w, cmdStdout)
+	var out io.Writer = w
+	if cacheWriter != nil {
+		out = io.MultiWriter(w, cacheWriter)
+	}
+	written, err := io.Copy(out, cmdStdout)
 	if err != nil {
 		httpAbort(w, err)
 		return
@@ -194,11 +376,76 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println(redactedArgs, "success")
+	if cacheTmp != nil {
+		name := cacheTmp.Name()
+		cacheTmp.Close()
+		if err := cache.put(key, name, written); err != nil {
+			log.Println("cache put failed:", err)
+		} else {
+			cacheTmp = nil // handed off to cache.put, nothing left to remove
+		}
+	}
+
+	succeeded = true
+	log.Println(identity, redactedArgs, "success")
 }
 
 func main() {
-	http.HandleFunc("/", handler)
-	log.Println("kwkhtmltopdf server listening on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	socket := flag.String("socket", "tcp::8080", "listen address as network:address (tcp, tcp4, tcp6, or unix), e.g. unix:/run/kwkhtmltopdf.sock")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; enables TLS together with --tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS key file; enables TLS together with --tls-cert")
+	shutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "how long to wait for in-flight renders to finish on SIGTERM/SIGINT")
+	flag.Parse()
+
+	auth, err := newAuthenticator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache, err := newCacheFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool, err := newRenderPoolFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs, err := newJobStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pol, err := newPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jobs != nil {
+		go func() {
+			for range time.Tick(time.Minute) {
+				jobs.cleanup()
+			}
+		}()
+	}
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, auth, cache, pool, jobs, pol)
+	})
+
+	ln, err := listen(*socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{}
+
+	// Serve returns as soon as Shutdown starts, so wait for Shutdown itself
+	// to finish before exiting or in-flight renders get cut off.
+	shutdownDone := make(chan struct{})
+	go func() {
+		waitForShutdown(srv, *shutdownGrace)
+		close(shutdownDone)
+	}()
+
+	log.Println("kwkhtmltopdf server listening on", *socket)
+	if err := serve(srv, ln, *tlsCert, *tlsKey); err != nil {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Println("shutdown complete")
 }
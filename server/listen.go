@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listen builds a net.Listener from a --socket spec of the form
+// "network:address", e.g. "tcp::8080", "tcp4:127.0.0.1:8080", or
+// "unix:/run/kwkhtmltopdf.sock". Supported networks are tcp, tcp4, tcp6,
+// and unix.
+func listen(spec string) (net.Listener, error) {
+	network, address, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid --socket %q: expected network:address", spec)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		// remove a stale socket file left behind by an unclean exit so a
+		// restart under systemd/k8s doesn't fail with "address in use"
+		os.Remove(address)
+	default:
+		return nil, fmt.Errorf("invalid --socket %q: unsupported network %q", spec, network)
+	}
+	return net.Listen(network, address)
+}
+
+// serve runs srv on ln, over TLS if tlsCert or tlsKey is set (ServeTLS
+// then fails unless both name usable files), and blocks until the server
+// stops (either from Shutdown or a fatal error).
+// It returns nil for the expected http.ErrServerClosed shutdown case.
+func serve(srv *http.Server, ln net.Listener, tlsCert, tlsKey string) error {
+	var err error
+	if tlsCert != "" || tlsKey != "" {
+		err = srv.ServeTLS(ln, tlsCert, tlsKey)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then gives srv up to
+// grace to finish in-flight renders before returning.
+func waitForShutdown(srv *http.Server, grace time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	log.Println("received", s, "- shutting down, grace period", grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown did not complete cleanly:", err)
+	}
+}
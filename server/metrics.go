@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// metricsHandler renders the render pool's counters in Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request, pool *renderPool) {
+	if r.Method != http.MethodGet {
+		httpError(w, fmt.Errorf("http method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := pool.snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP kwkhtmltopdf_queue_depth Requests waiting for a render worker slot.")
+	fmt.Fprintln(w, "# TYPE kwkhtmltopdf_queue_depth gauge")
+	fmt.Fprintf(w, "kwkhtmltopdf_queue_depth %d\n", s.queueDepth)
+
+	fmt.Fprintln(w, "# HELP kwkhtmltopdf_in_flight Renders currently running.")
+	fmt.Fprintln(w, "# TYPE kwkhtmltopdf_in_flight gauge")
+	fmt.Fprintf(w, "kwkhtmltopdf_in_flight %d\n", s.inFlight)
+
+	fmt.Fprintln(w, "# HELP kwkhtmltopdf_render_seconds_avg Average render duration in seconds.")
+	fmt.Fprintln(w, "# TYPE kwkhtmltopdf_render_seconds_avg gauge")
+	fmt.Fprintf(w, "kwkhtmltopdf_render_seconds_avg %f\n", s.avgRenderSecs)
+
+	fmt.Fprintln(w, "# HELP kwkhtmltopdf_renders_total Completed renders, success or failure.")
+	fmt.Fprintln(w, "# TYPE kwkhtmltopdf_renders_total counter")
+	fmt.Fprintf(w, "kwkhtmltopdf_renders_total %d\n", s.renders)
+
+	fmt.Fprintln(w, "# HELP kwkhtmltopdf_errors_total Renders that ended in an error.")
+	fmt.Fprintln(w, "# TYPE kwkhtmltopdf_errors_total counter")
+	fmt.Fprintf(w, "kwkhtmltopdf_errors_total %d\n", s.errors)
+}
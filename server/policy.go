@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// optionSpec describes how many value tokens follow a wkhtmltopdf flag in
+// the "option" part sequence (e.g. --cookie takes a name and a value,
+// submitted as two further parts) and whether those values should be
+// masked in logs.
+type optionSpec struct {
+	arity     int
+	sensitive bool
+}
+
+// knownOptions covers the flags this module has historically had to
+// reason about specially (see the old redactArgs --cookie case) plus the
+// ones called out as dangerous: local file access, cookie jars, and
+// script/post execution.
+var knownOptions = map[string]optionSpec{
+	"--cookie":                   {arity: 2, sensitive: true},
+	"--cookie-jar":               {arity: 1, sensitive: false},
+	"--password":                 {arity: 1, sensitive: true},
+	"--ssl-key-password":         {arity: 1, sensitive: true},
+	"--proxy":                    {arity: 1, sensitive: true},
+	"--post":                     {arity: 2, sensitive: false},
+	"--post-file":                {arity: 2, sensitive: false},
+	"--run-script":               {arity: 1, sensitive: false},
+	"--allow":                    {arity: 1, sensitive: false},
+	"--enable-local-file-access": {arity: 0, sensitive: false},
+}
+
+// defaultDeny is the "safe" profile applied when no policy file is
+// configured: it blocks local file access, cookie jars, and script/post
+// execution, the options called out as dangerous to expose to untrusted
+// callers.
+var defaultDeny = []string{
+	"--enable-local-file-access",
+	"--allow",
+	"--post-file",
+	"--post",
+	"--run-script",
+	"--cookie-jar",
+}
+
+// policy is the allow-list/deny-list/value-validation ruleset applied to
+// incoming option arguments, loaded from KWKHTMLTOPDF_POLICY_FILE.
+type policy struct {
+	// Allow, if non-empty, is the exhaustive set of permitted flags; any
+	// flag not in it is rejected. Deny is checked first regardless.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Sensitive maps additional flags (beyond the built-in defaults)
+	// whose values should be masked in logs to their arity: how many
+	// value tokens follow the flag in the "option" part sequence (most
+	// flags take exactly one value, so 1 covers the common case; use 0
+	// for a bare flag and 2+ for something like --cookie's name/value
+	// pair).
+	Sensitive map[string]int `json:"sensitive,omitempty"`
+	// ValueRules maps a flag to a regexp its (first) value must match.
+	ValueRules map[string]string `json:"value_rules,omitempty"`
+
+	deny       map[string]bool
+	allow      map[string]bool
+	valueRules map[string]*regexp.Regexp
+}
+
+// defaultPolicy returns the built-in "safe" profile used when
+// KWKHTMLTOPDF_POLICY_FILE is not set.
+func defaultPolicy() *policy {
+	p := &policy{Deny: append([]string(nil), defaultDeny...)}
+	if err := p.compile(); err != nil {
+		// defaultDeny is a static, known-good list; a compile failure here
+		// would be a programming error, not a runtime condition.
+		panic(err)
+	}
+	return p
+}
+
+func (p *policy) compile() error {
+	p.deny = make(map[string]bool, len(p.Deny))
+	for _, f := range p.Deny {
+		p.deny[f] = true
+	}
+	p.allow = make(map[string]bool, len(p.Allow))
+	for _, f := range p.Allow {
+		p.allow[f] = true
+	}
+	p.valueRules = make(map[string]*regexp.Regexp, len(p.ValueRules))
+	for flag, pattern := range p.ValueRules {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("policy: invalid value_rules pattern for %s: %w", flag, err)
+		}
+		p.valueRules[flag] = re
+	}
+	return nil
+}
+
+// newPolicyFromEnv loads the policy from KWKHTMLTOPDF_POLICY_FILE (JSON),
+// or returns the built-in safe profile if it's not set.
+func newPolicyFromEnv() (*policy, error) {
+	path := os.Getenv("KWKHTMLTOPDF_POLICY_FILE")
+	if path == "" {
+		return defaultPolicy(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *policy) isSensitive(flag string) bool {
+	if spec, known := knownOptions[flag]; known && spec.sensitive {
+		return true
+	}
+	_, sensitive := p.Sensitive[flag]
+	return sensitive
+}
+
+// arity returns how many value tokens follow flag, checking the static
+// knownOptions table first and falling back to the policy's own
+// Sensitive map so a policy-declared sensitive flag not in knownOptions
+// still gets its values grouped (and masked) correctly instead of
+// defaulting to 0 and leaking in plaintext.
+func (p *policy) arity(flag string) int {
+	if spec, known := knownOptions[flag]; known {
+		return spec.arity
+	}
+	if arity, ok := p.Sensitive[flag]; ok {
+		return arity
+	}
+	return 0
+}
+
+// policyViolation lists the offending options found in a request, for a
+// structured 400 response.
+type policyViolation struct {
+	Flag   string `json:"flag"`
+	Reason string `json:"reason"`
+}
+
+// validate walks optionArgs, grouping each flag with the value tokens
+// that follow it per p.arity, and reports every flag denied by the
+// policy, not on the allow-list (when one is configured), or whose value
+// fails its configured regex.
+func (p *policy) validate(optionArgs []string) []policyViolation {
+	var violations []policyViolation
+	for i := 0; i < len(optionArgs); i++ {
+		flag := optionArgs[i]
+		if !strings.HasPrefix(flag, "-") {
+			continue
+		}
+
+		if p.deny[flag] {
+			violations = append(violations, policyViolation{flag, "denied by policy"})
+		} else if len(p.allow) > 0 && !p.allow[flag] && !isDocOption(flag) {
+			violations = append(violations, policyViolation{flag, "not in allow-list"})
+		}
+
+		if re, ok := p.valueRules[flag]; ok && i+1 < len(optionArgs) {
+			if !re.MatchString(optionArgs[i+1]) {
+				violations = append(violations, policyViolation{flag, "value does not match policy pattern"})
+			}
+		}
+
+		i += p.arity(flag)
+	}
+	return violations
+}
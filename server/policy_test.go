@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestPolicyArityFallsBackToSensitiveMap(t *testing.T) {
+	pol := &policy{Sensitive: map[string]int{"--custom-secret": 2}}
+	if err := pol.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	if got := pol.arity("--custom-secret"); got != 2 {
+		t.Errorf("arity(--custom-secret) = %d, want 2 (from policy's Sensitive map)", got)
+	}
+	if got := pol.arity("--cookie"); got != knownOptions["--cookie"].arity {
+		t.Errorf("arity(--cookie) = %d, want the knownOptions value of %d", got, knownOptions["--cookie"].arity)
+	}
+	if got := pol.arity("--never-heard-of-it"); got != 0 {
+		t.Errorf("arity(--never-heard-of-it) = %d, want 0", got)
+	}
+}
+
+func TestPolicyIsSensitiveCoversPolicyDeclaredFlags(t *testing.T) {
+	pol := &policy{Sensitive: map[string]int{"--custom-secret": 1}}
+	if err := pol.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	if !pol.isSensitive("--custom-secret") {
+		t.Error("expected --custom-secret to be sensitive per the policy's Sensitive map")
+	}
+	if !pol.isSensitive("--password") {
+		t.Error("expected --password to be sensitive per knownOptions")
+	}
+	if pol.isSensitive("--allow") {
+		t.Error("expected --allow to not be sensitive")
+	}
+}
+
+func TestDefaultPolicyDeniesDangerousFlags(t *testing.T) {
+	pol := defaultPolicy()
+	for _, flag := range defaultDeny {
+		violations := pol.validate([]string{flag})
+		if len(violations) == 0 {
+			t.Errorf("expected the default policy to deny %s", flag)
+		}
+	}
+}
+
+func TestPolicyValidateAllowList(t *testing.T) {
+	pol := &policy{Allow: []string{"--grayscale"}}
+	if err := pol.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	if v := pol.validate([]string{"--grayscale"}); len(v) != 0 {
+		t.Errorf("expected --grayscale to pass the allow-list, got violations: %v", v)
+	}
+	if v := pol.validate([]string{"--orientation", "Landscape"}); len(v) == 0 {
+		t.Error("expected a flag not on the allow-list to be rejected")
+	}
+}
+
+func TestPolicyValidateValueRules(t *testing.T) {
+	pol := &policy{ValueRules: map[string]string{"--orientation": "^(Portrait|Landscape)$"}}
+	if err := pol.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	if v := pol.validate([]string{"--orientation", "Landscape"}); len(v) != 0 {
+		t.Errorf("expected a matching value to pass, got violations: %v", v)
+	}
+	if v := pol.validate([]string{"--orientation", "sideways"}); len(v) == 0 {
+		t.Error("expected a non-matching value to be rejected")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// errQueueFull is returned by renderPool.acquire when the bounded queue of
+// requests waiting for a worker slot is already at capacity.
+var errQueueFull = errors.New("render queue full")
+
+// renderPool bounds the number of wkhtmltopdf processes running at once
+// and the number of requests allowed to wait for a slot, so that a burst
+// of traffic backs off instead of forking an unbounded number of child
+// processes.
+type renderPool struct {
+	slots chan struct{}
+	queue int32 // requests currently waiting for a slot
+	limit int32 // max requests allowed to wait
+
+	queueTimeout time.Duration // max time a request may wait for a slot, 0 = no limit
+
+	inFlight      int32
+	renders       uint64
+	errors        uint64
+	totalDuration int64 // nanoseconds, accessed atomically
+}
+
+// newRenderPool creates a pool with the given number of worker slots and
+// queue capacity. A queueTimeout of 0 means a queued request waits
+// indefinitely for a slot (bounded only by the client disconnecting).
+func newRenderPool(workers, queueLimit int, queueTimeout time.Duration) *renderPool {
+	return &renderPool{
+		slots:        make(chan struct{}, workers),
+		limit:        int32(queueLimit),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// newRenderPoolFromEnv sizes the pool from KWKHTMLTOPDF_MAX_WORKERS
+// (default GOMAXPROCS), KWKHTMLTOPDF_QUEUE_SIZE (default 4x workers), and
+// KWKHTMLTOPDF_QUEUE_TIMEOUT (a duration string like "30s", default 30s;
+// "0" disables the timeout).
+func newRenderPoolFromEnv() (*renderPool, error) {
+	workers := runtime.GOMAXPROCS(0)
+	if v := os.Getenv("KWKHTMLTOPDF_MAX_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid KWKHTMLTOPDF_MAX_WORKERS: %q", v)
+		}
+		workers = n
+	}
+	queueSize := workers * 4
+	if v := os.Getenv("KWKHTMLTOPDF_QUEUE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid KWKHTMLTOPDF_QUEUE_SIZE: %q", v)
+		}
+		queueSize = n
+	}
+	queueTimeout := 30 * time.Second
+	if v := os.Getenv("KWKHTMLTOPDF_QUEUE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid KWKHTMLTOPDF_QUEUE_TIMEOUT: %q", v)
+		}
+		queueTimeout = d
+	}
+	return newRenderPool(workers, queueSize, queueTimeout), nil
+}
+
+// acquire blocks until a worker slot is free, ctx is done, the queue wait
+// exceeds p.queueTimeout (in which case it returns context.DeadlineExceeded),
+// or the queue is full (in which case it returns errQueueFull immediately
+// without waiting). The returned release func must be called, exactly
+// once, when the caller is done with the slot; it also records the
+// render's outcome and duration for /metrics.
+func (p *renderPool) acquire(ctx context.Context) (release func(succeeded bool), err error) {
+	if atomic.AddInt32(&p.queue, 1) > p.limit {
+		atomic.AddInt32(&p.queue, -1)
+		return nil, errQueueFull
+	}
+
+	if p.queueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.queueTimeout)
+		defer cancel()
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		atomic.AddInt32(&p.queue, -1)
+	case <-ctx.Done():
+		atomic.AddInt32(&p.queue, -1)
+		return nil, ctx.Err()
+	}
+
+	atomic.AddInt32(&p.inFlight, 1)
+	start := time.Now()
+	return func(succeeded bool) {
+		<-p.slots
+		atomic.AddInt32(&p.inFlight, -1)
+		atomic.AddInt64(&p.totalDuration, int64(time.Since(start)))
+		atomic.AddUint64(&p.renders, 1)
+		if !succeeded {
+			atomic.AddUint64(&p.errors, 1)
+		}
+	}, nil
+}
+
+// snapshot is a point-in-time read of the pool's counters, used to render
+// /metrics.
+type poolSnapshot struct {
+	queueDepth    int32
+	inFlight      int32
+	renders       uint64
+	errors        uint64
+	avgRenderSecs float64
+}
+
+func (p *renderPool) snapshot() poolSnapshot {
+	renders := atomic.LoadUint64(&p.renders)
+	total := atomic.LoadInt64(&p.totalDuration)
+	var avg float64
+	if renders > 0 {
+		avg = (time.Duration(total) / time.Duration(renders)).Seconds()
+	}
+	return poolSnapshot{
+		queueDepth:    atomic.LoadInt32(&p.queue),
+		inFlight:      atomic.LoadInt32(&p.inFlight),
+		renders:       renders,
+		errors:        atomic.LoadUint64(&p.errors),
+		avgRenderSecs: avg,
+	}
+}
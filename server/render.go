@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// renderAsset is an inline file (e.g. a logo referenced by relative path
+// from html) to materialize alongside the request's HTML.
+type renderAsset struct {
+	Name    string `json:"name"`
+	Content string `json:"content"` // base64
+}
+
+// renderJSONRequest is the body accepted by POST /render, a friendlier
+// alternative to hand-rolling the multipart body /pdf expects.
+type renderJSONRequest struct {
+	URL        string            `json:"url,omitempty"`
+	HTML       string            `json:"html,omitempty"`
+	HeaderHTML string            `json:"header_html,omitempty"`
+	FooterHTML string            `json:"footer_html,omitempty"`
+	Options    map[string]string `json:"options,omitempty"`
+	Assets     []renderAsset     `json:"assets,omitempty"`
+}
+
+// serveRender implements POST /render: it materializes the JSON request's
+// inline HTML and assets into a temp dir, translates options into CLI
+// flags, and renders exactly like /pdf.
+func serveRender(w http.ResponseWriter, r *http.Request, identity string, cache *renderCache, pool *renderPool, pol *policy) {
+	var req renderJSONRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if (req.URL == "") == (req.HTML == "") {
+		httpError(w, errors.New("exactly one of \"url\" or \"html\" is required"), http.StatusBadRequest)
+		return
+	}
+
+	tmpdir, err := ioutil.TempDir("", "kwk-render")
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fileHashes := make(map[string]string)
+	writeAsset := func(name string, content []byte) (string, error) {
+		name = filepath.Base(name)
+		path := filepath.Join(tmpdir, name)
+		if err := ioutil.WriteFile(path, content, 0o644); err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(content)
+		fileHashes[name] = hex.EncodeToString(sum[:])
+		return path, nil
+	}
+
+	for _, asset := range req.Assets {
+		content, err := base64.StdEncoding.DecodeString(asset.Content)
+		if err != nil {
+			httpError(w, errors.New("asset "+asset.Name+": invalid base64 content"), http.StatusBadRequest)
+			return
+		}
+		if _, err := writeAsset(asset.Name, content); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// optionArgs is the canonical form used for policy checks and the
+	// cache key: file-backed flags reference the file's content hash
+	// rather than its (request-specific, tmpdir-rooted) path, so
+	// identical requests still produce the same key.
+	var args, optionArgs []string
+	keys := make([]string, 0, len(req.Options))
+	for k := range req.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--"+k)
+		optionArgs = append(optionArgs, "--"+k)
+		if v := req.Options[k]; v != "" {
+			args = append(args, v)
+			optionArgs = append(optionArgs, v)
+		}
+	}
+
+	addFileOption := func(flag, assetName string, content []byte) error {
+		path, err := writeAsset(assetName, content)
+		if err != nil {
+			return err
+		}
+		args = append(args, flag, path)
+		optionArgs = append(optionArgs, flag, "sha256:"+fileHashes[assetName])
+		return nil
+	}
+
+	if req.HeaderHTML != "" {
+		if err := addFileOption("--header-html", "header.html", []byte(req.HeaderHTML)); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.FooterHTML != "" {
+		if err := addFileOption("--footer-html", "footer.html", []byte(req.FooterHTML)); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if violations := pol.validate(optionArgs); len(violations) > 0 {
+		httpJSONError(w, http.StatusBadRequest, violations)
+		return
+	}
+
+	var source string
+	if req.URL != "" {
+		source = req.URL
+		// the URL is an input too, so it belongs in the cache key
+		optionArgs = append(optionArgs, req.URL)
+	} else {
+		source, err = writeAsset("input.html", []byte(req.HTML))
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	args = append(args, source, "-")
+
+	w.Header().Set("Content-Type", "application/pdf")
+	renderAndStream(w, r, identity, args, optionArgs, fileHashes, cache != nil, cache, pool, pol)
+}